@@ -19,17 +19,11 @@ package cbauth
 import (
 	"fmt"
 	"net/http"
+	"sync"
 
 	"github.com/couchbase/cbauth/cbauthimpl"
 )
 
-// TODO: consider API that would allow us to do digest auth behind the
-// scene
-
-// TODO: for GetHTTPServiceAuth consider something more generic such
-// as GetHTTPAuthHeader. Or even maybe RoundTrip. So that we can
-// handle digest auth
-
 // Authenticator is main cbauth interface. It supports both incoming
 // and outgoing auth.
 type Authenticator interface {
@@ -43,6 +37,31 @@ type Authenticator interface {
 	// GetMemcachedServiceAuth returns user/password creds given
 	// "admin" access to given memcached service.
 	GetMemcachedServiceAuth(hostport string) (user, pwd string, err error)
+	// SetJWTConfig enables local verification of Authorization: Bearer
+	// JWTs in AuthWebCreds, so that such requests no longer need to
+	// round-trip to ns_server's /_auth.
+	SetJWTConfig(cfg JWTConfig) error
+	// AuthHeader sets the Authorization header of req to the right
+	// admin credentials for req's host:port: Digest if a Digest
+	// challenge from that host:port has already been seen by a client
+	// from NewHTTPClient, Basic otherwise.
+	AuthHeader(req *http.Request) error
+	// NewHTTPClient returns an *http.Client whose RoundTripper
+	// automatically attaches admin credentials (Basic or Digest, as
+	// required) to requests sent to hostport.
+	NewHTTPClient(hostport string) (*http.Client, error)
+	// SetPermissionCacheConfig enables (or reconfigures) a local TTL
+	// cache of IsAllowed decisions, so that repeated permission checks
+	// for the same (user, source, permission) don't all round-trip to
+	// ns_server.
+	SetPermissionCacheConfig(cfg PermissionCacheConfig)
+	// InvalidatePermissionCache discards every cached IsAllowed
+	// decision. Callers driving cbauthimpl.Svc.UpdateDB must call this
+	// right after, so the cache never outlives the database snapshot
+	// it was computed from.
+	InvalidatePermissionCache()
+	// Stats returns the permission cache's hit/miss/eviction counters.
+	Stats() Stats
 }
 
 // Creds type represents credentials and answers queries on this creds
@@ -62,6 +81,22 @@ var _ Creds = (*cbauthimpl.CredsImpl)(nil)
 
 type authImpl struct {
 	svc *cbauthimpl.Svc
+
+	// jwtMu guards jwtVerifier, which is non-nil once SetJWTConfig has
+	// been called, and enables local verification of Authorization:
+	// Bearer JWTs.
+	jwtMu       sync.Mutex
+	jwtVerifier *jwtVerifier
+
+	// digestMu guards digestByHost, which caches the most recently
+	// seen Digest challenge per host:port for AuthHeader/NewHTTPClient.
+	digestMu     sync.Mutex
+	digestByHost map[string]*digestState
+
+	// permCacheMu guards permCache, which is non-nil once
+	// SetPermissionCacheConfig has been called.
+	permCacheMu sync.Mutex
+	permCache   *permissionCache
 }
 
 // DBStaleError is kind of error that signals that cbauth internal
@@ -90,18 +125,51 @@ func (s UnknownHostPortError) Error() string {
 }
 
 func (a *authImpl) AuthWebCreds(req *http.Request) (creds Creds, err error) {
+	a.jwtMu.Lock()
+	verifier := a.jwtVerifier
+	a.jwtMu.Unlock()
+
+	if verifier != nil {
+		if tok := bearerToken(req); tok != "" {
+			creds, err = verifier.verify(tok, a.svc, req.Header)
+			return a.wrapWithPermissionCache(creds, err)
+		}
+	}
 	if cbauthimpl.IsAuthTokenPresent(req) {
-		return cbauthimpl.VerifyOnServer(a.svc, req.Header)
+		creds, err = cbauthimpl.VerifyOnServer(a.svc, req.Header)
+		return a.wrapWithPermissionCache(creds, err)
 	}
 	user, pwd, err := ExtractCreds(req)
 	if err != nil {
 		return nil, err
 	}
-	return cbauthimpl.VerifyPassword(a.svc, user, pwd)
+	creds, err = cbauthimpl.VerifyPassword(a.svc, user, pwd)
+	return a.wrapWithPermissionCache(creds, err)
+}
+
+// SetJWTConfig enables local verification of Authorization: Bearer JWTs
+// in AuthWebCreds, avoiding a round-trip to ns_server's /_auth for
+// requests that carry a bearer token.
+func (a *authImpl) SetJWTConfig(cfg JWTConfig) error {
+	v, err := newJWTVerifier(cfg)
+	if err != nil {
+		return err
+	}
+
+	a.jwtMu.Lock()
+	old := a.jwtVerifier
+	a.jwtVerifier = v
+	a.jwtMu.Unlock()
+
+	if old != nil {
+		old.Stop()
+	}
+	return nil
 }
 
 func (a *authImpl) Auth(user, pwd string) (creds Creds, err error) {
-	return cbauthimpl.VerifyPassword(a.svc, user, pwd)
+	creds, err = cbauthimpl.VerifyPassword(a.svc, user, pwd)
+	return a.wrapWithPermissionCache(creds, err)
 }
 
 func (a *authImpl) GetMemcachedServiceAuth(hostport string) (user, pwd string, err error) {
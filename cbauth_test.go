@@ -18,7 +18,7 @@ import (
 )
 
 func newAuth(initPeriod time.Duration) *authImpl {
-	return &authImpl{cbauthimpl.NewSVC(initPeriod, &DBStaleError{})}
+	return &authImpl{svc: cbauthimpl.NewSVC(initPeriod, &DBStaleError{})}
 }
 
 func must(err error) {
@@ -51,7 +51,7 @@ func newAuthForTest(body func(freshChan chan struct{}, timeoutBody func())) *aut
 		body(ch, timeoutBody)
 	}
 
-	return &authImpl{cbauthimpl.NewSVCForTest(testDur, &DBStaleError{}, wf)}
+	return &authImpl{svc: cbauthimpl.NewSVCForTest(testDur, &DBStaleError{}, wf)}
 }
 
 func acc(ok bool, err error) bool {
@@ -93,6 +93,9 @@ type testingRoundTripper struct {
 	source  string
 	token   string
 	tripped bool
+
+	permCallsMu sync.Mutex
+	permCalls   map[string]int
 }
 
 func newTestingRT(t *testing.T) *testingRoundTripper {
@@ -155,6 +158,13 @@ func (rt *testingRoundTripper) permissionsRoundTrip(req *http.Request) (res *htt
 		log.Fatalf("Missing parameters in request: %s", req.URL.String())
 	}
 
+	rt.permCallsMu.Lock()
+	if rt.permCalls == nil {
+		rt.permCalls = map[string]int{}
+	}
+	rt.permCalls[user[0]+"/"+src[0]+"/"+permission[0]]++
+	rt.permCallsMu.Unlock()
+
 	statusCode := 401
 
 	switch src[0] {
@@ -386,6 +396,113 @@ func TestBucketsAuth(t *testing.T) {
 	}
 }
 
+func TestBucketsAuthPermissionCache(t *testing.T) {
+	rt := newTestingRT(t)
+	defer applyRT(rt)()
+
+	a := newAuth(0)
+	cache := newCache(a)
+	cache.Buckets = append(cbauthimpl.Cache{}.Buckets, mkBucket("foo", "bar"))
+	must(a.svc.UpdateDB(cache, nil))
+
+	a.SetPermissionCacheConfig(PermissionCacheConfig{
+		Size:                  16,
+		PermissionTTL:         time.Minute,
+		NegativePermissionTTL: time.Minute,
+	})
+
+	c, err := a.Auth("foo", "bar")
+	must(err)
+
+	const n = 50
+	var wg sync.WaitGroup
+	wg.Add(n)
+	for i := 0; i < n; i++ {
+		go func() {
+			defer wg.Done()
+			if !canAccessBucket(c, "foo") {
+				t.Error("Expect foo access with right pw to work")
+			}
+		}()
+	}
+	wg.Wait()
+
+	rt.permCallsMu.Lock()
+	calls := rt.permCalls["foo/bucket/cluster.bucket[foo].data!write"]
+	rt.permCallsMu.Unlock()
+
+	if calls != 1 {
+		t.Fatalf("Expect exactly one /_permissions call within the TTL window for %d concurrent callers, got %d", n, calls)
+	}
+
+	stats := a.Stats()
+	if stats.Misses != 1 {
+		t.Fatalf("Expect exactly one cache miss for %d concurrent callers, got %d", n, stats.Misses)
+	}
+}
+
+// TestPermissionCacheInvalidation checks that InvalidatePermissionCache
+// wholesale-discards cached decisions, so that a DB change (rotating
+// the generation counter) is reflected by the very next IsAllowed
+// call instead of serving a stale entry for the rest of its TTL.
+func TestPermissionCacheInvalidation(t *testing.T) {
+	rt := newTestingRT(t)
+	defer applyRT(rt)()
+
+	a := newAuth(0)
+	cache := newCache(a)
+	cache.Buckets = append(cbauthimpl.Cache{}.Buckets, mkBucket("foo", "bar"))
+	must(a.svc.UpdateDB(cache, nil))
+
+	a.SetPermissionCacheConfig(PermissionCacheConfig{
+		Size:                  16,
+		PermissionTTL:         time.Minute,
+		NegativePermissionTTL: time.Minute,
+	})
+
+	c, err := a.Auth("foo", "bar")
+	must(err)
+
+	const key = "foo/bucket/cluster.bucket[foo].data!write"
+
+	if !canAccessBucket(c, "foo") {
+		t.Fatal("Expect foo access with right pw to work")
+	}
+	if !canAccessBucket(c, "foo") {
+		t.Fatal("Expect foo access with right pw to work")
+	}
+
+	rt.permCallsMu.Lock()
+	calls := rt.permCalls[key]
+	rt.permCallsMu.Unlock()
+	if calls != 1 {
+		t.Fatalf("Expect the second call within the TTL window to be served from cache, got %d /_permissions calls", calls)
+	}
+	if stats := a.Stats(); stats.Hits != 1 || stats.Misses != 1 {
+		t.Fatalf("Expect 1 hit and 1 miss before invalidation, got %+v", stats)
+	}
+
+	// Simulate whatever drives Svc.UpdateDB also invalidating the
+	// permission cache, as InvalidatePermissionCache's doc comment
+	// requires.
+	must(a.svc.UpdateDB(cache, nil))
+	a.InvalidatePermissionCache()
+
+	if !canAccessBucket(c, "foo") {
+		t.Fatal("Expect foo access with right pw to still work after a DB update")
+	}
+
+	rt.permCallsMu.Lock()
+	calls = rt.permCalls[key]
+	rt.permCallsMu.Unlock()
+	if calls != 2 {
+		t.Fatalf("Expect InvalidatePermissionCache to force a fresh /_permissions call, got %d total calls", calls)
+	}
+	if stats := a.Stats(); stats.Misses != 2 {
+		t.Fatalf("Expect the post-invalidation call to be a cache miss, got %+v", stats)
+	}
+}
+
 func mkNode(host, user, pwd string, ports []int, local bool) (rv cbauthimpl.Node) {
 	rv.Host = host
 	rv.User = user
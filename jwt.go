@@ -0,0 +1,496 @@
+// @author Couchbase <info@couchbase.com>
+// @copyright 2014-2016 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cbauth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/couchbase/cbauth/cbauthimpl"
+)
+
+// defaultJWKSRefreshPeriod is how often the JWKS document is re-fetched
+// in the background when JWTConfig.JWKSURL is set.
+const defaultJWKSRefreshPeriod = 5 * time.Minute
+
+// ClaimMappings describes which JWT claims carry the pieces of identity
+// and authorization cbauth needs. Any field left blank falls back to
+// its default.
+type ClaimMappings struct {
+	// UserClaim is the claim holding the user name. Defaults to "sub".
+	UserClaim string
+	// SourceClaim is the claim holding the user source (for
+	// auditing). Defaults to "" which maps to a fixed "jwt" source.
+	SourceClaim string
+	// PermissionsClaim is the claim holding the list of permissions
+	// (and, prefixed with "-", denials) granted to the token. Entries
+	// may contain "*" wildcards, e.g. "cluster.bucket[*].data!write".
+	// Defaults to "permissions".
+	PermissionsClaim string
+}
+
+// JWTConfig configures local verification of Authorization: Bearer JWTs
+// in AuthWebCreds, avoiding a round-trip to ns_server's /_auth for
+// requests that carry a bearer token.
+type JWTConfig struct {
+	// JWKSURL, when set, is periodically fetched to populate the set
+	// of keys usable to verify RS256/ES256 tokens, indexed by "kid".
+	JWKSURL string
+	// JWKSRefreshPeriod controls how often JWKSURL is re-fetched.
+	// Defaults to 5 minutes.
+	JWKSRefreshPeriod time.Duration
+	// StaticKeys supplements (or replaces) JWKSURL with a fixed set of
+	// verification keys indexed by "kid". Values must be
+	// *rsa.PublicKey, *ecdsa.PublicKey or []byte (HMAC secret).
+	StaticKeys map[string]interface{}
+	// AllowedAlgorithms restricts which "alg" header values are
+	// accepted. Defaults to RS256, ES256 and HS256.
+	AllowedAlgorithms []string
+	// ClaimMappings customizes which claims carry user/source/
+	// permissions.
+	ClaimMappings ClaimMappings
+	// ClockSkew is the tolerance applied when checking "exp"/"nbf".
+	ClockSkew time.Duration
+}
+
+var defaultAllowedAlgorithms = []string{"RS256", "ES256", "HS256"}
+
+var errJWTMalformed = errors.New("cbauth: malformed JWT")
+var errJWTBadSignature = errors.New("cbauth: JWT signature verification failed")
+var errJWTExpired = errors.New("cbauth: JWT is expired")
+var errJWTUnknownKey = errors.New("cbauth: JWT references an unknown signing key")
+var errJWTNoUser = errors.New("cbauth: JWT does not carry a user claim")
+
+// jwtVerifier implements local verification of bearer JWTs, including
+// rotation-safe refresh of JWKS-provided keys.
+type jwtVerifier struct {
+	cfg JWTConfig
+
+	staticKeys map[string]interface{}
+
+	mu       sync.RWMutex
+	jwksKeys map[string]interface{}
+
+	stopOnce sync.Once
+	stopCh   chan struct{}
+}
+
+func newJWTVerifier(cfg JWTConfig) (*jwtVerifier, error) {
+	if cfg.ClaimMappings.UserClaim == "" {
+		cfg.ClaimMappings.UserClaim = "sub"
+	}
+	if cfg.ClaimMappings.PermissionsClaim == "" {
+		cfg.ClaimMappings.PermissionsClaim = "permissions"
+	}
+	if len(cfg.AllowedAlgorithms) == 0 {
+		cfg.AllowedAlgorithms = defaultAllowedAlgorithms
+	}
+	if cfg.JWKSRefreshPeriod == 0 {
+		cfg.JWKSRefreshPeriod = defaultJWKSRefreshPeriod
+	}
+
+	v := &jwtVerifier{
+		cfg:        cfg,
+		staticKeys: cfg.StaticKeys,
+		jwksKeys:   map[string]interface{}{},
+		stopCh:     make(chan struct{}),
+	}
+
+	if cfg.JWKSURL != "" {
+		if err := v.refreshJWKS(); err != nil {
+			return nil, fmt.Errorf("cbauth: initial JWKS fetch of %s failed: %s", cfg.JWKSURL, err)
+		}
+		go v.refreshLoop()
+	}
+
+	return v, nil
+}
+
+func (v *jwtVerifier) Stop() {
+	v.stopOnce.Do(func() { close(v.stopCh) })
+}
+
+func (v *jwtVerifier) refreshLoop() {
+	t := time.NewTicker(v.cfg.JWKSRefreshPeriod)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			_ = v.refreshJWKS()
+		case <-v.stopCh:
+			return
+		}
+	}
+}
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+	K   string `json:"k"`
+}
+
+type jwks struct {
+	Keys []jwk `json:"keys"`
+}
+
+func (v *jwtVerifier) refreshJWKS() error {
+	resp, err := http.Get(v.cfg.JWKSURL)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("need 200 status, got %d", resp.StatusCode)
+	}
+
+	var doc jwks
+	if err := json.NewDecoder(resp.Body).Decode(&doc); err != nil {
+		return err
+	}
+
+	keys := make(map[string]interface{}, len(doc.Keys))
+	for _, k := range doc.Keys {
+		key, err := parseJWK(k)
+		if err != nil {
+			continue
+		}
+		keys[k.Kid] = key
+	}
+
+	v.mu.Lock()
+	v.jwksKeys = keys
+	v.mu.Unlock()
+	return nil
+}
+
+func parseJWK(k jwk) (interface{}, error) {
+	switch k.Kty {
+	case "RSA":
+		nb, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, err
+		}
+		eb, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return nil, err
+		}
+		e := 0
+		for _, b := range eb {
+			e = e<<8 | int(b)
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(nb), E: e}, nil
+	case "EC":
+		xb, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return nil, err
+		}
+		yb, err := base64.RawURLEncoding.DecodeString(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{
+			Curve: ellipticCurve(k.Crv),
+			X:     new(big.Int).SetBytes(xb),
+			Y:     new(big.Int).SetBytes(yb),
+		}, nil
+	default:
+		return nil, fmt.Errorf("cbauth: unsupported JWK kty %q", k.Kty)
+	}
+}
+
+func ellipticCurve(crv string) elliptic.Curve {
+	switch crv {
+	case "P-384":
+		return elliptic.P384()
+	case "P-521":
+		return elliptic.P521()
+	default:
+		return elliptic.P256()
+	}
+}
+
+func (v *jwtVerifier) lookupKey(kid string) (interface{}, bool) {
+	if kid != "" {
+		if k, ok := v.staticKeys[kid]; ok {
+			return k, true
+		}
+		v.mu.RLock()
+		k, ok := v.jwksKeys[kid]
+		v.mu.RUnlock()
+		if ok {
+			return k, true
+		}
+		return nil, false
+	}
+	// No "kid" in the token header: usable only if there's exactly one
+	// static key configured (common for HS256 deployments).
+	if len(v.staticKeys) == 1 {
+		for _, k := range v.staticKeys {
+			return k, true
+		}
+	}
+	return nil, false
+}
+
+func (v *jwtVerifier) allowedAlgorithm(alg string) bool {
+	for _, a := range v.cfg.AllowedAlgorithms {
+		if a == alg {
+			return true
+		}
+	}
+	return false
+}
+
+// verify checks tokenString's signature and expiry and builds Creds out
+// of its claims. header/svc are threaded through so that IsAllowed can
+// fall back to cbauthimpl.VerifyOnServer for permissions not covered by
+// the token's own permission claims.
+func (v *jwtVerifier) verify(tokenString string, svc *cbauthimpl.Svc, header http.Header) (*JWTCreds, error) {
+	parts := strings.Split(tokenString, ".")
+	if len(parts) != 3 {
+		return nil, errJWTMalformed
+	}
+
+	headerJSON, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, errJWTMalformed
+	}
+	payloadJSON, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, errJWTMalformed
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errJWTMalformed
+	}
+
+	var jwtHeader struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := json.Unmarshal(headerJSON, &jwtHeader); err != nil {
+		return nil, errJWTMalformed
+	}
+	if !v.allowedAlgorithm(jwtHeader.Alg) {
+		return nil, fmt.Errorf("cbauth: JWT alg %q is not allowed", jwtHeader.Alg)
+	}
+
+	key, ok := v.lookupKey(jwtHeader.Kid)
+	if !ok {
+		return nil, errJWTUnknownKey
+	}
+
+	signingInput := []byte(parts[0] + "." + parts[1])
+	if err := verifyJWTSignature(jwtHeader.Alg, key, signingInput, sig); err != nil {
+		return nil, err
+	}
+
+	var claims map[string]interface{}
+	if err := json.Unmarshal(payloadJSON, &claims); err != nil {
+		return nil, errJWTMalformed
+	}
+
+	if exp, ok := claims["exp"].(float64); ok {
+		if time.Now().After(time.Unix(int64(exp), 0).Add(v.cfg.ClockSkew)) {
+			return nil, errJWTExpired
+		}
+	}
+	if nbf, ok := claims["nbf"].(float64); ok {
+		if time.Now().Before(time.Unix(int64(nbf), 0).Add(-v.cfg.ClockSkew)) {
+			return nil, errJWTMalformed
+		}
+	}
+
+	user, _ := claims[v.cfg.ClaimMappings.UserClaim].(string)
+	if user == "" {
+		return nil, errJWTNoUser
+	}
+	source := "jwt"
+	if v.cfg.ClaimMappings.SourceClaim != "" {
+		if s, ok := claims[v.cfg.ClaimMappings.SourceClaim].(string); ok && s != "" {
+			source = s
+		}
+	}
+
+	var allow, deny []string
+	if raw, ok := claims[v.cfg.ClaimMappings.PermissionsClaim].([]interface{}); ok {
+		for _, p := range raw {
+			s, ok := p.(string)
+			if !ok {
+				continue
+			}
+			if strings.HasPrefix(s, "-") {
+				deny = append(deny, s[1:])
+			} else {
+				allow = append(allow, s)
+			}
+		}
+	}
+
+	return &JWTCreds{
+		name:   user,
+		source: source,
+		allow:  allow,
+		deny:   deny,
+		fallback: func(permission string) (bool, error) {
+			c, err := cbauthimpl.VerifyOnServer(svc, header)
+			if err != nil {
+				return false, err
+			}
+			return c.IsAllowed(permission)
+		},
+	}, nil
+}
+
+func verifyJWTSignature(alg string, key interface{}, signingInput, sig []byte) error {
+	switch alg {
+	case "HS256":
+		secret, ok := key.([]byte)
+		if !ok {
+			return errJWTUnknownKey
+		}
+		mac := hmac.New(sha256.New, secret)
+		mac.Write(signingInput)
+		if !hmac.Equal(mac.Sum(nil), sig) {
+			return errJWTBadSignature
+		}
+		return nil
+	case "RS256":
+		pub, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return errJWTUnknownKey
+		}
+		h := sha256.Sum256(signingInput)
+		if err := rsa.VerifyPKCS1v15(pub, crypto.SHA256, h[:], sig); err != nil {
+			return errJWTBadSignature
+		}
+		return nil
+	case "ES256":
+		pub, ok := key.(*ecdsa.PublicKey)
+		if !ok {
+			return errJWTUnknownKey
+		}
+		if len(sig) != 64 {
+			return errJWTBadSignature
+		}
+		r := new(big.Int).SetBytes(sig[:32])
+		s := new(big.Int).SetBytes(sig[32:])
+		h := sha256.Sum256(signingInput)
+		if !ecdsa.Verify(pub, h[:], r, s) {
+			return errJWTBadSignature
+		}
+		return nil
+	default:
+		return fmt.Errorf("cbauth: unsupported JWT alg %q", alg)
+	}
+}
+
+// JWTCreds is the Creds implementation returned for requests
+// authenticated via a local JWT verification (see JWTConfig).
+type JWTCreds struct {
+	name   string
+	source string
+	allow  []string
+	deny   []string
+
+	// fallback is consulted for permissions not covered by allow/deny,
+	// round-tripping to ns_server the same way token auth normally does.
+	fallback func(permission string) (bool, error)
+}
+
+var _ Creds = (*JWTCreds)(nil)
+
+// Name method returns user name (e.g. for auditing)
+func (c *JWTCreds) Name() string {
+	return c.name
+}
+
+// Source method returns user source (for auditing)
+func (c *JWTCreds) Source() string {
+	return c.source
+}
+
+// IsAllowed method returns true if the permission is granted for these
+// credentials. Embedded deny/allow permission claims are consulted
+// first; if the permission is covered by neither, the decision is
+// delegated to VerifyOnServer.
+func (c *JWTCreds) IsAllowed(permission string) (bool, error) {
+	for _, p := range c.deny {
+		if jwtPermissionMatches(p, permission) {
+			return false, nil
+		}
+	}
+	for _, p := range c.allow {
+		if jwtPermissionMatches(p, permission) {
+			return true, nil
+		}
+	}
+	if c.fallback == nil {
+		return false, nil
+	}
+	return c.fallback(permission)
+}
+
+// jwtPermissionMatches reports whether permission is covered by
+// pattern, where pattern may use "*" as a wildcard, e.g.
+// "cluster.bucket[*].data!write".
+func jwtPermissionMatches(pattern, permission string) bool {
+	if pattern == permission {
+		return true
+	}
+	if !strings.Contains(pattern, "*") {
+		return false
+	}
+	parts := strings.Split(pattern, "*")
+	quoted := make([]string, len(parts))
+	for i, p := range parts {
+		quoted[i] = regexp.QuoteMeta(p)
+	}
+	re, err := regexp.Compile("^" + strings.Join(quoted, ".*") + "$")
+	if err != nil {
+		return false
+	}
+	return re.MatchString(permission)
+}
+
+func bearerToken(req *http.Request) string {
+	const prefix = "Bearer "
+	h := req.Header.Get("Authorization")
+	if len(h) <= len(prefix) || !strings.EqualFold(h[:len(prefix)], prefix) {
+		return ""
+	}
+	return h[len(prefix):]
+}
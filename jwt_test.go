@@ -0,0 +1,129 @@
+package cbauth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+func mintHS256(t *testing.T, secret []byte, kid string, claims map[string]interface{}) string {
+	header := map[string]interface{}{"alg": "HS256", "typ": "JWT"}
+	if kid != "" {
+		header["kid"] = kid
+	}
+
+	headerJSON, err := json.Marshal(header)
+	must(err)
+	claimsJSON, err := json.Marshal(claims)
+	must(err)
+
+	signingInput := base64.RawURLEncoding.EncodeToString(headerJSON) + "." +
+		base64.RawURLEncoding.EncodeToString(claimsJSON)
+
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(signingInput))
+	sig := base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+
+	return signingInput + "." + sig
+}
+
+func TestJWTAdmin(t *testing.T) {
+	secret := []byte("unit-test-signing-key")
+
+	a := newAuth(0)
+	must(a.SetJWTConfig(JWTConfig{
+		StaticKeys:    map[string]interface{}{"test-key": secret},
+		ClaimMappings: ClaimMappings{SourceClaim: "iss"},
+	}))
+
+	token := mintHS256(t, secret, "test-key", map[string]interface{}{
+		"sub": "Administrator",
+		"iss": "admin",
+		"permissions": []interface{}{
+			"cluster.admin.settings!write",
+			"cluster.bucket[*].data!write",
+		},
+	})
+
+	req, err := http.NewRequest("GET", "http://q:11234/_queryStatsmaybe", nil)
+	must(err)
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	c, err := a.AuthWebCreds(req)
+	must(err)
+
+	assertAdmins(t, c, true, false)
+
+	if c.Name() != "Administrator" {
+		t.Errorf("Expect name to be Administrator")
+	}
+	if c.Source() != "admin" {
+		t.Errorf("Expect source to be admin. Got %s", c.Source())
+	}
+	if !canAccessBucket(c, "asdasdasdasd") {
+		t.Errorf("Expected to be able to access all buckets. Failed at asdasdasdasd")
+	}
+	if !canAccessBucket(c, "ffee") {
+		t.Errorf("Expected to be able to access all buckets. Failed at ffee")
+	}
+}
+
+func TestJWTBucketUser(t *testing.T) {
+	secret := []byte("unit-test-signing-key")
+
+	a := newAuth(0)
+	must(a.SetJWTConfig(JWTConfig{
+		StaticKeys: map[string]interface{}{"test-key": secret},
+	}))
+
+	token := mintHS256(t, secret, "test-key", map[string]interface{}{
+		"sub": "foo",
+		"permissions": []interface{}{
+			"cluster.bucket[foo].data!write",
+			"-cluster.bucket[default].data!write",
+		},
+	})
+
+	req, err := http.NewRequest("GET", "http://q:11234/_queryStatsmaybe", nil)
+	must(err)
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	c, err := a.AuthWebCreds(req)
+	must(err)
+
+	if c.Source() != "jwt" {
+		t.Errorf("Expect default source to be jwt. Got %s", c.Source())
+	}
+	if !canAccessBucket(c, "foo") {
+		t.Fatal("Expect foo access to work")
+	}
+	if canAccessBucket(c, "default") {
+		t.Fatal("Expect default bucket access to be denied by the token's deny claim")
+	}
+}
+
+func TestJWTExpired(t *testing.T) {
+	secret := []byte("unit-test-signing-key")
+
+	a := newAuth(0)
+	must(a.SetJWTConfig(JWTConfig{
+		StaticKeys: map[string]interface{}{"test-key": secret},
+	}))
+
+	token := mintHS256(t, secret, "test-key", map[string]interface{}{
+		"sub": "foo",
+		"exp": float64(1),
+	})
+
+	req, err := http.NewRequest("GET", "http://q:11234/_queryStatsmaybe", nil)
+	must(err)
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	_, err = a.AuthWebCreds(req)
+	if err != errJWTExpired {
+		t.Fatalf("Expect expired JWT to be rejected. Got %v", err)
+	}
+}
@@ -0,0 +1,308 @@
+package cbauth
+
+import (
+	"flag"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/couchbase/cbauth/cbauthimpl"
+)
+
+// long gates the linearizability harness below: it runs real wall-clock
+// concurrent traffic against a.svc while a driver goroutine repeatedly
+// calls UpdateDB, so it's slow and is skipped by default.
+var long = flag.Bool("long", false, "run long-running/stress tests, e.g. TestUpdateDBLinearizability")
+
+// TestCheckLinearizabilityDetectsImpossibleSuccess is a small,
+// fast, non-concurrent regression test for checkLinearizability itself:
+// a "successful" call that finished before the update to the version
+// it claims to have observed even started can't be explained under
+// any linearization, and must be reported as a violation rather than
+// silently accepted.
+func TestCheckLinearizabilityDetectsImpossibleSuccess(t *testing.T) {
+	base := time.Now()
+	events := []updateEvent{
+		{version: 0},
+		{version: 1, start: base.Add(10 * time.Second), end: base.Add(20 * time.Second)},
+	}
+	results := []callResult{
+		{op: "auth", version: 1, success: true, start: base.Add(1 * time.Second), end: base.Add(5 * time.Second)},
+	}
+
+	if why := checkLinearizability(events, results); why == "" {
+		t.Fatal("expected a violation to be reported, got none")
+	}
+}
+
+// TestCheckLinearizabilityAcceptsValidInteriorPoint makes sure the fix
+// above didn't turn the checker overly strict: a linearization point
+// strictly between an update's start and end (not at either endpoint)
+// must still be found when one exists.
+func TestCheckLinearizabilityAcceptsValidInteriorPoint(t *testing.T) {
+	base := time.Now()
+	events := []updateEvent{
+		{version: 0},
+		{version: 1, start: base, end: base.Add(100 * time.Millisecond)},
+	}
+	results := []callResult{
+		// Only consistent with a linearization point somewhere in
+		// (base+10ms, base+50ms], strictly inside the update's own
+		// interval and not at either endpoint.
+		{op: "auth", version: 0, success: true, start: base.Add(10 * time.Millisecond), end: base.Add(20 * time.Millisecond)},
+		{op: "auth", version: 1, success: true, start: base.Add(40 * time.Millisecond), end: base.Add(50 * time.Millisecond)},
+	}
+
+	if why := checkLinearizability(events, results); why != "" {
+		t.Fatalf("expected no violation, got: %s", why)
+	}
+}
+
+func adminPwForVersion(v int) string {
+	return fmt.Sprintf("adminpw%d", v)
+}
+
+func nodePortForVersion(v int) int {
+	return 9000 + v
+}
+
+// updateEvent records the wall-clock interval a single Svc.UpdateDB
+// call was in flight for, and which version it swapped in.
+type updateEvent struct {
+	version    int
+	start, end time.Time
+}
+
+type callResult struct {
+	op         string
+	version    int
+	success    bool
+	start, end time.Time
+}
+
+// TestUpdateDBLinearizability spawns concurrent callers issuing
+// Auth/AuthWebCreds/GetHTTPServiceAuth traffic against a handful of
+// admin credentials while a driver goroutine repeatedly swaps the
+// Cache snapshot underneath them (rotating the admin password and the
+// node's service port each time), then checks that every observed
+// result is consistent with *some* total order of the UpdateDB calls
+// that respects each call's own start/end interval.
+func TestUpdateDBLinearizability(t *testing.T) {
+	if !*long {
+		t.Skip("skipping long-running test; pass -long to run it")
+	}
+
+	const versions = 6
+	const workers = 12
+	const callsPerWorker = 200
+
+	a := newAuth(0)
+
+	must(a.svc.UpdateDB(&cbauthimpl.Cache{
+		Users: []cbauthimpl.User{mkUser("admin", "admin", adminPwForVersion(0), "salt0")},
+		Nodes: []cbauthimpl.Node{mkNode("n", "unused", "x", []int{nodePortForVersion(0)}, false)},
+	}, nil))
+
+	events := []updateEvent{{version: 0}}
+
+	var resultsMu sync.Mutex
+	var results []callResult
+
+	stop := make(chan struct{})
+	driverDone := make(chan struct{})
+
+	go func() {
+		defer close(driverDone)
+		for v := 1; v <= versions; v++ {
+			time.Sleep(time.Duration(rand.Intn(3)) * time.Millisecond)
+
+			start := time.Now()
+			must(a.svc.UpdateDB(&cbauthimpl.Cache{
+				Users: []cbauthimpl.User{mkUser("admin", "admin", adminPwForVersion(v), fmt.Sprintf("salt%d", v))},
+				Nodes: []cbauthimpl.Node{mkNode("n", "unused", "x", []int{nodePortForVersion(v)}, false)},
+			}, nil))
+			end := time.Now()
+
+			resultsMu.Lock()
+			events = append(events, updateEvent{version: v, start: start, end: end})
+			resultsMu.Unlock()
+		}
+		close(stop)
+	}()
+
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func(seed int64) {
+			defer wg.Done()
+			rnd := rand.New(rand.NewSource(seed))
+
+			for j := 0; j < callsPerWorker; j++ {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+
+				v := rnd.Intn(versions + 1)
+				op := []string{"auth", "webcreds", "http"}[rnd.Intn(3)]
+
+				start := time.Now()
+				var success bool
+				switch op {
+				case "auth":
+					_, err := a.Auth("admin", adminPwForVersion(v))
+					success = err == nil
+				case "webcreds":
+					req, err := http.NewRequest("GET", "http://n/whatever", nil)
+					must(err)
+					req.SetBasicAuth("admin", adminPwForVersion(v))
+					_, err = a.AuthWebCreds(req)
+					success = err == nil
+				case "http":
+					_, _, err := a.GetHTTPServiceAuth(fmt.Sprintf("n:%d", nodePortForVersion(v)))
+					success = err == nil
+				}
+				end := time.Now()
+
+				resultsMu.Lock()
+				results = append(results, callResult{op: op, version: v, success: success, start: start, end: end})
+				resultsMu.Unlock()
+			}
+		}(int64(i) + 1)
+	}
+
+	wg.Wait()
+	<-driverDone
+
+	if violation := checkLinearizability(events, results); violation != "" {
+		t.Fatalf("linearizability violation: %s", violation)
+	}
+}
+
+// epsilon is used to turn a strict "point > t" / "point <= t" bound
+// into the non-strict form time.Time comparisons give us directly.
+const epsilon = time.Nanosecond
+
+// checkLinearizability looks for an assignment of a linearization
+// point to every update event (anywhere between its start and end,
+// not just at those two endpoints) such that every recorded call
+// result is consistent with the resulting total order. Update events
+// don't overlap each other (a single driver goroutine issues them one
+// at a time), so their relative order is already fixed; what's free is
+// exactly *when* within its own [start, end] each swap is deemed to
+// take effect.
+//
+// lo[v]/hi[v] track the current feasible range for event v's
+// linearization point (lo[0]/hi[k-1]'s "outer" neighbors are treated
+// as -inf/+inf). A successful call observing version v requires
+// lo[v] <= call.end and hi[v+1] > call.start, which only ever tighten
+// the range, so those are applied directly. A failed call observing
+// version v requires lo[v] > call.start OR hi[v+1] <= call.end; since
+// that's a disjunction we try tightening lo[v] first and fall back to
+// tightening hi[v+1] if that would make the range infeasible. This
+// isn't a fully general constraint solver (it doesn't backtrack across
+// multiple failed disjunctions once a choice is made), but it's enough
+// to explain any real execution, where the vast majority of calls
+// land entirely before or after the update they're racing with.
+func checkLinearizability(events []updateEvent, results []callResult) string {
+	k := len(events)
+
+	lo := make([]time.Time, k) // lo[0] intentionally left zero == -inf
+	hi := make([]time.Time, k) // hi[0] left zero: version 0 has no update of its own
+	for i := 1; i < k; i++ {
+		lo[i] = events[i].start
+		hi[i] = events[i].end
+	}
+
+	// window bounds for version v: [point_v, point_{v+1}), treating a
+	// nonexistent index as -inf/+inf.
+	windowLo := func(v int) (t time.Time, isInf bool) {
+		if v == 0 {
+			return time.Time{}, true
+		}
+		return lo[v], false
+	}
+	windowHi := func(v int) (t time.Time, isInf bool) {
+		if v+1 >= k {
+			return time.Time{}, true
+		}
+		return hi[v+1], false
+	}
+
+	// Successes only ever tighten point_v's own feasible range
+	// (point_v <= call.end narrows hi[v]; point_{v+1} > call.start
+	// narrows lo[v+1]), so apply them first and unconditionally; any
+	// resulting infeasibility (lo[i] > hi[i]) is caught below, not
+	// papered over by moving a bound past the event's own interval.
+	for _, r := range results {
+		if !r.success {
+			continue
+		}
+		if r.version > 0 {
+			hi[r.version] = minTime(hi[r.version], r.end)
+		}
+		if r.version+1 < k {
+			lo[r.version+1] = maxTime(lo[r.version+1], r.start.Add(epsilon))
+		}
+	}
+	for i := 1; i < k; i++ {
+		if lo[i].After(hi[i]) {
+			return fmt.Sprintf("no linearization point for update to version %d satisfies every "+
+				"successful call that observed it or its neighbor", events[i].version)
+		}
+	}
+
+	for _, r := range results {
+		if r.success {
+			continue
+		}
+		l, loInf := windowLo(r.version)
+		h, hiInf := windowHi(r.version)
+		branch1 := !loInf && l.After(r.start) // point_v > call.start already guaranteed
+		branch2 := !hiInf && !h.After(r.end)  // point_{v+1} <= call.end already guaranteed
+		if branch1 || branch2 {
+			continue
+		}
+
+		// Neither branch is already satisfied: try tightening lo[v]
+		// past call.start first.
+		if !loInf {
+			newLo := maxTime(lo[r.version], r.start.Add(epsilon))
+			if !newLo.After(hi[r.version]) {
+				lo[r.version] = newLo
+				continue
+			}
+		}
+		// Fall back to tightening hi[v+1] down to call.end.
+		if !hiInf {
+			newHi := minTime(hi[r.version+1], r.end)
+			if !newHi.Before(lo[r.version+1]) {
+				hi[r.version+1] = newHi
+				continue
+			}
+		}
+
+		return fmt.Sprintf("%s call for version %d (%s-%s) failed but that version's window can't be "+
+			"made to exclude the entire call under any remaining linearization", r.op, r.version, r.start, r.end)
+	}
+
+	return ""
+}
+
+func minTime(a, b time.Time) time.Time {
+	if a.IsZero() || b.Before(a) {
+		return b
+	}
+	return a
+}
+
+func maxTime(a, b time.Time) time.Time {
+	if a.IsZero() || b.After(a) {
+		return b
+	}
+	return a
+}
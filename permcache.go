@@ -0,0 +1,259 @@
+// @author Couchbase <info@couchbase.com>
+// @copyright 2014-2016 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cbauth
+
+import (
+	"container/list"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// PermissionCacheConfig configures the local cache of IsAllowed
+// decisions used to avoid a /_permissions round-trip on every call.
+//
+// Ideally this would travel as extra fields on cbauthimpl.Cache
+// (PermissionCacheSize/PermissionTTL/NegativePermissionTTL), the same
+// way Users/Buckets/Nodes do, and be pushed down via Svc.UpdateDB. This
+// tree doesn't carry the cbauthimpl package, so it's configured
+// directly on the Authenticator instead; InvalidatePermissionCache
+// needs to be called by whatever drives Svc.UpdateDB for the cache to
+// track database changes.
+type PermissionCacheConfig struct {
+	// Size caps the number of (user, source, permission) entries kept.
+	Size int
+	// PermissionTTL is how long a positive decision is cached.
+	PermissionTTL time.Duration
+	// NegativePermissionTTL is how long a negative decision is
+	// cached. Kept shorter than PermissionTTL to limit the blast
+	// radius of a stale deny.
+	NegativePermissionTTL time.Duration
+}
+
+// Stats reports permission cache activity, as returned by
+// Authenticator.Stats.
+type Stats struct {
+	Hits      uint64
+	Misses    uint64
+	Evictions uint64
+}
+
+type permCacheKey struct {
+	user, source, permission string
+}
+
+type permCacheEntry struct {
+	key        permCacheKey
+	allowed    bool
+	expiresAt  time.Time
+	generation uint64
+}
+
+// inflightCall coalesces concurrent misses for the same key into a
+// single upstream IsAllowed call.
+type inflightCall struct {
+	done    chan struct{}
+	allowed bool
+	err     error
+}
+
+// permissionCache is a generation-stamped, TTL'd LRU cache of IsAllowed
+// decisions. Entries are invalidated wholesale by bumping the
+// generation counter rather than walking/clearing the map, so
+// invalidation stays cheap regardless of cache size.
+type permissionCache struct {
+	cfg PermissionCacheConfig
+
+	mu         sync.Mutex
+	generation uint64
+	ll         *list.List
+	items      map[permCacheKey]*list.Element
+	inflight   map[permCacheKey]*inflightCall
+
+	hits, misses, evictions uint64
+}
+
+func newPermissionCache(cfg PermissionCacheConfig) *permissionCache {
+	return &permissionCache{
+		cfg:      cfg,
+		ll:       list.New(),
+		items:    map[permCacheKey]*list.Element{},
+		inflight: map[permCacheKey]*inflightCall{},
+	}
+}
+
+// invalidateAll discards every cached decision, e.g. because the
+// underlying cbauthimpl database was just updated.
+func (c *permissionCache) invalidateAll() {
+	c.mu.Lock()
+	c.generation++
+	c.mu.Unlock()
+}
+
+func (c *permissionCache) stats() Stats {
+	return Stats{
+		Hits:      atomic.LoadUint64(&c.hits),
+		Misses:    atomic.LoadUint64(&c.misses),
+		Evictions: atomic.LoadUint64(&c.evictions),
+	}
+}
+
+func (c *permissionCache) lookupLocked(key permCacheKey) (permCacheEntry, bool) {
+	el, ok := c.items[key]
+	if !ok {
+		return permCacheEntry{}, false
+	}
+	e := el.Value.(permCacheEntry)
+	if e.generation != c.generation || time.Now().After(e.expiresAt) {
+		c.ll.Remove(el)
+		delete(c.items, key)
+		return permCacheEntry{}, false
+	}
+	c.ll.MoveToFront(el)
+	return e, true
+}
+
+func (c *permissionCache) insertLocked(key permCacheKey, allowed bool, ttl time.Duration) {
+	e := permCacheEntry{key: key, allowed: allowed, expiresAt: time.Now().Add(ttl), generation: c.generation}
+	if el, ok := c.items[key]; ok {
+		el.Value = e
+		c.ll.MoveToFront(el)
+		return
+	}
+	c.items[key] = c.ll.PushFront(e)
+	if c.cfg.Size > 0 {
+		for len(c.items) > c.cfg.Size {
+			oldest := c.ll.Back()
+			if oldest == nil {
+				break
+			}
+			c.ll.Remove(oldest)
+			delete(c.items, oldest.Value.(permCacheEntry).key)
+			atomic.AddUint64(&c.evictions, 1)
+		}
+	}
+}
+
+// getOrFetch returns the cached decision for key, or calls fetch to
+// obtain and cache one. Concurrent callers racing on the same key share
+// a single fetch call.
+func (c *permissionCache) getOrFetch(key permCacheKey, fetch func() (bool, error)) (bool, error) {
+	c.mu.Lock()
+	if e, ok := c.lookupLocked(key); ok {
+		c.mu.Unlock()
+		atomic.AddUint64(&c.hits, 1)
+		return e.allowed, nil
+	}
+	if call, ok := c.inflight[key]; ok {
+		c.mu.Unlock()
+		<-call.done
+		return call.allowed, call.err
+	}
+	call := &inflightCall{done: make(chan struct{})}
+	c.inflight[key] = call
+	gen := c.generation
+	c.mu.Unlock()
+
+	atomic.AddUint64(&c.misses, 1)
+	allowed, err := fetch()
+	call.allowed, call.err = allowed, err
+	close(call.done)
+
+	c.mu.Lock()
+	delete(c.inflight, key)
+	// A decision fetched across an invalidateAll is not cached.
+	if err == nil && gen == c.generation {
+		ttl := c.cfg.PermissionTTL
+		if !allowed {
+			ttl = c.cfg.NegativePermissionTTL
+		}
+		c.insertLocked(key, allowed, ttl)
+	}
+	c.mu.Unlock()
+
+	return allowed, err
+}
+
+// cachingCreds wraps another Creds, caching its IsAllowed decisions.
+type cachingCreds struct {
+	inner        Creds
+	user, source string
+	cache        *permissionCache
+}
+
+var _ Creds = (*cachingCreds)(nil)
+
+func (c *cachingCreds) Name() string   { return c.inner.Name() }
+func (c *cachingCreds) Source() string { return c.inner.Source() }
+
+func (c *cachingCreds) IsAllowed(permission string) (bool, error) {
+	key := permCacheKey{user: c.user, source: c.source, permission: permission}
+	return c.cache.getOrFetch(key, func() (bool, error) {
+		return c.inner.IsAllowed(permission)
+	})
+}
+
+// wrapWithPermissionCache wraps creds with the authenticator's
+// permission cache, if one is configured.
+func (a *authImpl) wrapWithPermissionCache(creds Creds, err error) (Creds, error) {
+	a.permCacheMu.Lock()
+	cache := a.permCache
+	a.permCacheMu.Unlock()
+
+	if err != nil || creds == nil || cache == nil {
+		return creds, err
+	}
+	return &cachingCreds{inner: creds, user: creds.Name(), source: creds.Source(), cache: cache}, nil
+}
+
+// SetPermissionCacheConfig enables (or reconfigures) the local
+// IsAllowed decision cache described by cfg. Passing a zero cfg
+// disables caching again.
+func (a *authImpl) SetPermissionCacheConfig(cfg PermissionCacheConfig) {
+	a.permCacheMu.Lock()
+	defer a.permCacheMu.Unlock()
+
+	if cfg == (PermissionCacheConfig{}) {
+		a.permCache = nil
+		return
+	}
+	a.permCache = newPermissionCache(cfg)
+}
+
+// InvalidatePermissionCache discards every cached IsAllowed decision.
+// It must be called after every cbauthimpl.Svc.UpdateDB so that the
+// cache can't outlive the database snapshot it was computed from.
+func (a *authImpl) InvalidatePermissionCache() {
+	a.permCacheMu.Lock()
+	cache := a.permCache
+	a.permCacheMu.Unlock()
+
+	if cache != nil {
+		cache.invalidateAll()
+	}
+}
+
+// Stats returns the permission cache's hit/miss/eviction counters.
+func (a *authImpl) Stats() Stats {
+	a.permCacheMu.Lock()
+	cache := a.permCache
+	a.permCacheMu.Unlock()
+
+	if cache == nil {
+		return Stats{}
+	}
+	return cache.stats()
+}
@@ -0,0 +1,266 @@
+// @author Couchbase <info@couchbase.com>
+// @copyright 2014-2016 Couchbase, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cbauth
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/rand"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// digestState tracks the most recent Digest challenge seen from a given
+// host, so that subsequent requests can present credentials up front
+// instead of waiting to be challenged every time. It also keeps the
+// "nc" nonce count required by RFC 7616 in sync across requests that
+// reuse the same server nonce.
+type digestState struct {
+	mu sync.Mutex
+
+	realm, nonce, opaque, qop, algorithm string
+	nc                                   uint32
+}
+
+func (s *digestState) setChallenge(params map[string]string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if params["nonce"] != s.nonce {
+		s.nc = 0
+	}
+	s.realm = params["realm"]
+	s.nonce = params["nonce"]
+	s.opaque = params["opaque"]
+	s.qop = firstQopOption(params["qop"])
+	s.algorithm = params["algorithm"]
+}
+
+func firstQopOption(qop string) string {
+	for _, opt := range strings.Split(qop, ",") {
+		opt = strings.TrimSpace(opt)
+		if opt == "auth" {
+			return opt
+		}
+	}
+	return ""
+}
+
+func md5hex(s string) string {
+	sum := md5.Sum([]byte(s))
+	return fmt.Sprintf("%x", sum)
+}
+
+func genCnonce() (string, error) {
+	buf := make([]byte, 8)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", buf), nil
+}
+
+// authorization builds the value of an Authorization: Digest header for
+// the given user/pwd/method/uri, per RFC 7616. It returns an error if
+// no challenge has been observed yet for this host.
+func (s *digestState) authorization(user, pwd, method, uri string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.nonce == "" {
+		return "", fmt.Errorf("cbauth: no digest challenge cached yet")
+	}
+
+	cnonce, err := genCnonce()
+	if err != nil {
+		return "", err
+	}
+	s.nc++
+	nc := fmt.Sprintf("%08x", s.nc)
+
+	ha1 := md5hex(user + ":" + s.realm + ":" + pwd)
+	if strings.EqualFold(s.algorithm, "MD5-sess") {
+		ha1 = md5hex(ha1 + ":" + s.nonce + ":" + cnonce)
+	}
+	ha2 := md5hex(method + ":" + uri)
+
+	var response string
+	if s.qop != "" {
+		response = md5hex(strings.Join([]string{ha1, s.nonce, nc, cnonce, s.qop, ha2}, ":"))
+	} else {
+		response = md5hex(ha1 + ":" + s.nonce + ":" + ha2)
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, `Digest username="%s", realm="%s", nonce="%s", uri="%s", response="%s"`,
+		user, s.realm, s.nonce, uri, response)
+	if s.opaque != "" {
+		fmt.Fprintf(&b, `, opaque="%s"`, s.opaque)
+	}
+	if s.algorithm != "" {
+		fmt.Fprintf(&b, `, algorithm=%s`, s.algorithm)
+	}
+	if s.qop != "" {
+		fmt.Fprintf(&b, `, qop=%s, nc=%s, cnonce="%s"`, s.qop, nc, cnonce)
+	}
+	return b.String(), nil
+}
+
+// parseWWWAuthenticate splits a WWW-Authenticate header into its scheme
+// and its comma-separated key="value" parameters.
+func parseWWWAuthenticate(header string) (scheme string, params map[string]string) {
+	header = strings.TrimSpace(header)
+	sp := strings.IndexByte(header, ' ')
+	if sp < 0 {
+		return header, nil
+	}
+	scheme = header[:sp]
+	params = map[string]string{}
+	for _, kv := range splitDigestParams(header[sp+1:]) {
+		eq := strings.IndexByte(kv, '=')
+		if eq < 0 {
+			continue
+		}
+		key := strings.TrimSpace(kv[:eq])
+		value := strings.Trim(strings.TrimSpace(kv[eq+1:]), `"`)
+		params[key] = value
+	}
+	return scheme, params
+}
+
+// splitDigestParams splits a Digest challenge's parameter list on
+// commas that aren't inside a quoted string.
+func splitDigestParams(s string) []string {
+	var parts []string
+	inQuotes := false
+	start := 0
+	for i, r := range s {
+		switch r {
+		case '"':
+			inQuotes = !inQuotes
+		case ',':
+			if !inQuotes {
+				parts = append(parts, s[start:i])
+				start = i + 1
+			}
+		}
+	}
+	parts = append(parts, s[start:])
+	return parts
+}
+
+func (a *authImpl) digestStateForHost(host string) *digestState {
+	a.digestMu.Lock()
+	defer a.digestMu.Unlock()
+
+	if a.digestByHost == nil {
+		a.digestByHost = map[string]*digestState{}
+	}
+	st, ok := a.digestByHost[host]
+	if !ok {
+		st = &digestState{}
+		a.digestByHost[host] = st
+	}
+	return st
+}
+
+// AuthHeader sets the Authorization header of req to the right admin
+// credentials for req's host, per Authenticator.
+func (a *authImpl) AuthHeader(req *http.Request) error {
+	hostport := req.URL.Host
+	user, pwd, err := a.GetHTTPServiceAuth(hostport)
+	if err != nil {
+		return err
+	}
+
+	st := a.digestStateForHost(hostport)
+	if h, err := st.authorization(user, pwd, req.Method, req.URL.RequestURI()); err == nil {
+		req.Header.Set("Authorization", h)
+		return nil
+	}
+
+	req.SetBasicAuth(user, pwd)
+	return nil
+}
+
+// authTransport is an http.RoundTripper that attaches admin
+// credentials to outgoing requests against a single cluster service,
+// transparently handling a Basic or Digest challenge.
+type authTransport struct {
+	auth     *authImpl
+	hostport string
+	base     http.RoundTripper
+}
+
+func (t *authTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	base := t.base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+
+	var bodyBytes []byte
+	if req.Body != nil {
+		var err error
+		bodyBytes, err = ioutil.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	clone := req.Clone(req.Context())
+	if bodyBytes != nil {
+		clone.Body = ioutil.NopCloser(bytes.NewReader(bodyBytes))
+	}
+
+	if err := t.auth.AuthHeader(clone); err != nil {
+		return nil, err
+	}
+
+	resp, err := base.RoundTrip(clone)
+	if err != nil || resp.StatusCode != http.StatusUnauthorized {
+		return resp, err
+	}
+
+	challenge := resp.Header.Get("WWW-Authenticate")
+	scheme, params := parseWWWAuthenticate(challenge)
+	if !strings.EqualFold(scheme, "Digest") {
+		return resp, err
+	}
+	resp.Body.Close()
+
+	t.auth.digestStateForHost(t.hostport).setChallenge(params)
+
+	retry := req.Clone(req.Context())
+	if bodyBytes != nil {
+		retry.Body = ioutil.NopCloser(bytes.NewReader(bodyBytes))
+	}
+	if err := t.auth.AuthHeader(retry); err != nil {
+		return nil, err
+	}
+	return base.RoundTrip(retry)
+}
+
+// NewHTTPClient returns an *http.Client that automatically attaches
+// admin credentials to requests made against hostport, per
+// Authenticator.
+func (a *authImpl) NewHTTPClient(hostport string) (*http.Client, error) {
+	if _, _, err := SplitHostPort(hostport); err != nil {
+		return nil, err
+	}
+	return &http.Client{Transport: &authTransport{auth: a, hostport: hostport}}, nil
+}
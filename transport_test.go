@@ -0,0 +1,103 @@
+package cbauth
+
+import (
+	"crypto/md5"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/couchbase/cbauth/cbauthimpl"
+)
+
+func md5hexTest(s string) string {
+	sum := md5.Sum([]byte(s))
+	return fmt.Sprintf("%x", sum)
+}
+
+// expectedDigestResponse recomputes the RFC 7616 "response" value given
+// the client-supplied nc/cnonce, so the test doesn't need to predict
+// them ahead of time.
+func expectedDigestResponse(user, realm, pwd, method, uri, nonce, nc, cnonce, qop string) string {
+	ha1 := md5hexTest(user + ":" + realm + ":" + pwd)
+	ha2 := md5hexTest(method + ":" + uri)
+	return md5hexTest(strings.Join([]string{ha1, nonce, nc, cnonce, qop, ha2}, ":"))
+}
+
+func TestDigestAuthTransport(t *testing.T) {
+	defer applyRT(newTestingRT(t))()
+
+	const user = "@component"
+	const pwd = "s3cr3t"
+	const realm = "testrealm"
+	const nonce = "testnonce1"
+
+	var seenNC []string
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/thing", func(w http.ResponseWriter, r *http.Request) {
+		auth := r.Header.Get("Authorization")
+		if !strings.HasPrefix(auth, "Digest ") {
+			w.Header().Set("WWW-Authenticate",
+				fmt.Sprintf(`Digest realm="%s", qop="auth", nonce="%s", opaque="testopaque"`, realm, nonce))
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		_, params := parseWWWAuthenticate(auth)
+		if params["nonce"] != nonce {
+			t.Fatalf("unexpected nonce: %s", params["nonce"])
+		}
+		want := expectedDigestResponse(user, realm, pwd, r.Method, params["uri"],
+			nonce, params["nc"], params["cnonce"], "auth")
+		if params["response"] != want {
+			t.Fatalf("digest response mismatch: got %s want %s", params["response"], want)
+		}
+		seenNC = append(seenNC, params["nc"])
+		w.WriteHeader(http.StatusOK)
+	})
+
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	u, err := url.Parse(server.URL)
+	must(err)
+	host, portStr, err := net.SplitHostPort(u.Host)
+	must(err)
+	port, err := strconv.Atoi(portStr)
+	must(err)
+
+	a := newAuth(0)
+	cache := newCache(a)
+	cache.SpecialUser = user
+	cache.Nodes = append(cbauthimpl.Cache{}.Nodes, mkNode(host, "unused", pwd, []int{port}, false))
+	must(a.svc.UpdateDB(cache, nil))
+
+	client, err := a.NewHTTPClient(u.Host)
+	must(err)
+
+	resp, err := client.Get(server.URL + "/thing")
+	must(err)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected first request to succeed after digest retry, got %d", resp.StatusCode)
+	}
+
+	resp, err = client.Get(server.URL + "/thing")
+	must(err)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected second request to succeed, got %d", resp.StatusCode)
+	}
+
+	if len(seenNC) != 2 {
+		t.Fatalf("expected exactly 2 authenticated requests, got %d", len(seenNC))
+	}
+	if seenNC[0] != "00000001" || seenNC[1] != "00000002" {
+		t.Fatalf("expected monotonically increasing nc, got %v", seenNC)
+	}
+}